@@ -0,0 +1,18 @@
+package tailfs
+
+import "tailscale.com/tailcfg"
+
+// ShareACL maps a share name to a predicate reporting whether the peer
+// identified by node/userLogin may access it. A share with no entry in
+// the map is open to any peer that can reach the server.
+type ShareACL map[string]func(node tailcfg.NodeView, userLogin string) bool
+
+// allows reports whether the peer identified by node/userLogin is
+// permitted to access the share named name.
+func (a ShareACL) allows(name string, node tailcfg.NodeView, userLogin string) bool {
+	pred, ok := a[name]
+	if !ok {
+		return true
+	}
+	return pred(node, userLogin)
+}
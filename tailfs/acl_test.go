@@ -0,0 +1,25 @@
+package tailfs
+
+import (
+	"testing"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestShareACLAllows(t *testing.T) {
+	acl := ShareACL{
+		"restricted": func(node tailcfg.NodeView, userLogin string) bool {
+			return userLogin == "alice@example.com"
+		},
+	}
+
+	if !acl.allows("restricted", tailcfg.NodeView{}, "alice@example.com") {
+		t.Error("expected alice to be allowed on restricted share")
+	}
+	if acl.allows("restricted", tailcfg.NodeView{}, "bob@example.com") {
+		t.Error("expected bob to be denied on restricted share")
+	}
+	if !acl.allows("open", tailcfg.NodeView{}, "bob@example.com") {
+		t.Error("expected share with no ACL entry to be open")
+	}
+}
@@ -0,0 +1,373 @@
+package tailfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backend is a storage backend that can be served as an SMB share. It
+// need not be backed by a local disk: a Backend can equally be an S3
+// bucket, a WebDAV endpoint, or (as with MemBackend) nothing at all,
+// provided it implements these seven operations.
+type Backend interface {
+	Open(name string) (fs.File, error)
+	Stat(name string) (fs.FileInfo, error)
+	Readdir(name string) ([]fs.DirEntry, error)
+	Create(name string) (io.WriteCloser, error)
+	Write(name string, p []byte, offset int64) (n int, err error)
+	Remove(name string) error
+	Rename(oldName, newName string) error
+}
+
+// backendFileSystem wraps a share's Backend as the Backend resolveShare
+// hands to serveSMB2, enforcing ShareOpts.ReadOnly for mutating
+// operations and recording the share's metrics (bytes transferred, open
+// handles).
+type backendFileSystem struct {
+	sh *share
+}
+
+func (fsys backendFileSystem) Open(name string) (fs.File, error) {
+	f, err := fsys.sh.backend.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fsys.sh.metrics.openHandles.Add(1)
+	return &countingFile{File: f, sh: fsys.sh}, nil
+}
+
+func (fsys backendFileSystem) Stat(name string) (fs.FileInfo, error) {
+	return fsys.sh.backend.Stat(name)
+}
+
+func (fsys backendFileSystem) Readdir(name string) ([]fs.DirEntry, error) {
+	return fsys.sh.backend.Readdir(name)
+}
+
+func (fsys backendFileSystem) Create(name string) (io.WriteCloser, error) {
+	if fsys.sh.opts.ReadOnly {
+		return nil, fmt.Errorf("create %v: %w", name, fs.ErrPermission)
+	}
+	w, err := fsys.sh.backend.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	fsys.sh.metrics.openHandles.Add(1)
+	return &countingWriteCloser{WriteCloser: w, sh: fsys.sh}, nil
+}
+
+func (fsys backendFileSystem) Write(name string, p []byte, offset int64) (int, error) {
+	if fsys.sh.opts.ReadOnly {
+		return 0, fmt.Errorf("write %v: %w", name, fs.ErrPermission)
+	}
+	n, err := fsys.sh.backend.Write(name, p, offset)
+	fsys.sh.metrics.bytesWritten.Add(int64(n))
+	return n, err
+}
+
+func (fsys backendFileSystem) Remove(name string) error {
+	if fsys.sh.opts.ReadOnly {
+		return fmt.Errorf("remove %v: %w", name, fs.ErrPermission)
+	}
+	return fsys.sh.backend.Remove(name)
+}
+
+func (fsys backendFileSystem) Rename(oldName, newName string) error {
+	if fsys.sh.opts.ReadOnly {
+		return fmt.Errorf("rename %v: %w", oldName, fs.ErrPermission)
+	}
+	return fsys.sh.backend.Rename(oldName, newName)
+}
+
+// countingFile wraps an fs.File returned by a Backend's Open, attributing
+// bytes read and the open handle to the owning share's metrics.
+type countingFile struct {
+	fs.File
+	sh *share
+}
+
+func (f *countingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.sh.metrics.bytesRead.Add(int64(n))
+	return n, err
+}
+
+func (f *countingFile) Close() error {
+	f.sh.metrics.openHandles.Add(-1)
+	return f.File.Close()
+}
+
+// countingWriteCloser wraps an io.WriteCloser returned by a Backend's
+// Create, attributing bytes written and the open handle to the owning
+// share's metrics.
+type countingWriteCloser struct {
+	io.WriteCloser
+	sh *share
+}
+
+func (w *countingWriteCloser) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.sh.metrics.bytesWritten.Add(int64(n))
+	return n, err
+}
+
+func (w *countingWriteCloser) Close() error {
+	w.sh.metrics.openHandles.Add(-1)
+	return w.WriteCloser.Close()
+}
+
+// LocalBackend returns a Backend that serves files from the local
+// directory tree rooted at root. This is the default backend used by
+// AddShare and preserves tailfs's original behavior.
+func LocalBackend(root string) Backend {
+	return &localBackend{root: root}
+}
+
+type localBackend struct {
+	root string
+}
+
+// path resolves name to an absolute path under b.root, rejecting any
+// name (however it's encoded, including "..", a leading slash, or a
+// symlink-free traversal) that would resolve outside of it. name comes
+// straight off the wire in smb2.go with no validation of its own, so
+// this is the only thing standing between a share and the rest of the
+// filesystem — notably the private directory chunk0-5 locks down.
+func (b *localBackend) path(name string) (string, error) {
+	joined := filepath.Join(b.root, filepath.FromSlash(name))
+	rel, err := filepath.Rel(b.root, joined)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%q escapes share root", name)
+	}
+	return joined, nil
+}
+
+func (b *localBackend) Open(name string) (fs.File, error) {
+	p, err := b.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (b *localBackend) Stat(name string) (fs.FileInfo, error) {
+	p, err := b.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+func (b *localBackend) Readdir(name string) ([]fs.DirEntry, error) {
+	p, err := b.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadDir(p)
+}
+
+func (b *localBackend) Create(name string) (io.WriteCloser, error) {
+	p, err := b.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Create(p)
+}
+
+func (b *localBackend) Write(name string, p []byte, offset int64) (int, error) {
+	path, err := b.path(name)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.WriteAt(p, offset)
+}
+
+func (b *localBackend) Remove(name string) error {
+	p, err := b.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (b *localBackend) Rename(oldName, newName string) error {
+	oldPath, err := b.path(oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := b.path(newName)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+// MemBackend returns an in-memory Backend with no persistent storage.
+// It is primarily useful for tests and for conformance-checking new
+// Backend implementations against LocalBackend. See WebDAVBackend for a
+// Backend that talks to a real remote store.
+func MemBackend() Backend {
+	return &memBackend{files: make(map[string]*memFile)}
+}
+
+type memFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+type memBackend struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+}
+
+func (b *memBackend) Open(name string) (fs.File, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := b.files[name]
+	if !ok {
+		return nil, fmt.Errorf("open %v: %w", name, fs.ErrNotExist)
+	}
+	return &memOpenFile{name: name, r: bytes.NewReader(f.data), size: int64(len(f.data)), modTime: f.modTime}, nil
+}
+
+func (b *memBackend) Stat(name string) (fs.FileInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := b.files[name]
+	if !ok {
+		return nil, fmt.Errorf("stat %v: %w", name, fs.ErrNotExist)
+	}
+	return memFileInfo{name: filepath.Base(name), size: int64(len(f.data)), modTime: f.modTime}, nil
+}
+
+func (b *memBackend) Readdir(name string) ([]fs.DirEntry, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	prefix := name
+	if prefix != "" && prefix != "/" {
+		prefix += "/"
+	} else {
+		prefix = ""
+	}
+
+	var entries []fs.DirEntry
+	for n, f := range b.files {
+		if !strings.HasPrefix(n, prefix) {
+			continue
+		}
+		rest := n[len(prefix):]
+		if rest == "" || strings.Contains(rest, "/") {
+			continue
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(memFileInfo{name: rest, size: int64(len(f.data)), modTime: f.modTime}))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (b *memBackend) Create(name string) (io.WriteCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f := &memFile{modTime: time.Now()}
+	b.files[name] = f
+	return &memWriteCloser{backend: b, name: name}, nil
+}
+
+func (b *memBackend) Write(name string, p []byte, offset int64) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := b.files[name]
+	if !ok {
+		return 0, fmt.Errorf("write %v: %w", name, fs.ErrNotExist)
+	}
+	end := offset + int64(len(p))
+	if end > int64(len(f.data)) {
+		grown := make([]byte, end)
+		copy(grown, f.data)
+		f.data = grown
+	}
+	copy(f.data[offset:], p)
+	f.modTime = time.Now()
+	return len(p), nil
+}
+
+func (b *memBackend) Remove(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.files[name]; !ok {
+		return fmt.Errorf("remove %v: %w", name, fs.ErrNotExist)
+	}
+	delete(b.files, name)
+	return nil
+}
+
+func (b *memBackend) Rename(oldName, newName string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := b.files[oldName]
+	if !ok {
+		return fmt.Errorf("rename %v: %w", oldName, fs.ErrNotExist)
+	}
+	delete(b.files, oldName)
+	b.files[newName] = f
+	return nil
+}
+
+// memWriteCloser accumulates writes and flushes them to the backend's
+// map on Close, mirroring the buffered-then-committed semantics that a
+// remote object-store backend would typically have.
+type memWriteCloser struct {
+	backend *memBackend
+	name    string
+	buf     bytes.Buffer
+}
+
+func (w *memWriteCloser) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *memWriteCloser) Close() error {
+	_, err := w.backend.Write(w.name, w.buf.Bytes(), 0)
+	return err
+}
+
+type memOpenFile struct {
+	name    string
+	r       *bytes.Reader
+	size    int64
+	modTime time.Time
+}
+
+func (f *memOpenFile) Stat() (fs.FileInfo, error) {
+	return memFileInfo{name: filepath.Base(f.name), size: f.size, modTime: f.modTime}, nil
+}
+
+func (f *memOpenFile) Read(p []byte) (int, error) { return f.r.Read(p) }
+func (f *memOpenFile) Close() error               { return nil }
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() fs.FileMode  { return 0644 }
+func (fi memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() any           { return nil }
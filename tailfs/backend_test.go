@@ -0,0 +1,149 @@
+package tailfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// backendFactories lists the Backend implementations that must pass the
+// conformance suite below.
+func backendFactories(t *testing.T) map[string]Backend {
+	return map[string]Backend{
+		"local": LocalBackend(t.TempDir()),
+		"mem":   MemBackend(),
+	}
+}
+
+func TestBackendConformance(t *testing.T) {
+	for name, b := range backendFactories(t) {
+		b := b
+		t.Run(name, func(t *testing.T) {
+			testBackendCreateWriteRead(t, b)
+			testBackendReaddir(t, b)
+			testBackendRenameAndRemove(t, b)
+		})
+	}
+}
+
+func testBackendCreateWriteRead(t *testing.T, b Backend) {
+	w, err := b.Create("hello.txt")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := w.Write([]byte("hello world")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	fi, err := b.Stat("hello.txt")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if fi.Size() != int64(len("hello world")) {
+		t.Fatalf("Stat size = %d, want %d", fi.Size(), len("hello world"))
+	}
+
+	f, err := b.Open("hello.txt")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "hello world" {
+		t.Fatalf("read %q, want %q", got, "hello world")
+	}
+}
+
+func testBackendReaddir(t *testing.T, b Backend) {
+	for _, name := range []string{"a.txt", "b.txt"} {
+		w, err := b.Create(name)
+		if err != nil {
+			t.Fatalf("Create(%v): %v", name, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close(%v): %v", name, err)
+		}
+	}
+
+	entries, err := b.Readdir("")
+	if err != nil {
+		t.Fatalf("Readdir: %v", err)
+	}
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		seen[e.Name()] = true
+	}
+	if !seen["a.txt"] || !seen["b.txt"] {
+		t.Fatalf("Readdir = %v, missing a.txt or b.txt", seen)
+	}
+}
+
+func testBackendRenameAndRemove(t *testing.T, b Backend) {
+	w, err := b.Create("old.txt")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if err := b.Rename("old.txt", "new.txt"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if _, err := b.Stat("new.txt"); err != nil {
+		t.Fatalf("Stat after rename: %v", err)
+	}
+
+	if err := b.Remove("new.txt"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, err := b.Stat("new.txt"); err == nil {
+		t.Fatal("expected Stat to fail after Remove")
+	}
+}
+
+// TestLocalBackendRejectsPathTraversal guards against a share serving
+// files outside its root: a name containing ".." must never resolve to
+// a path that escapes root, however it's encoded.
+func TestLocalBackendRejectsPathTraversal(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	secret := filepath.Join(filepath.Dir(root), "secret")
+	if err := os.WriteFile(secret, []byte("shh"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	b := LocalBackend(root)
+	names := []string{
+		"../secret",
+		"sub/../../secret",
+		"../../../../etc/passwd",
+		"..",
+	}
+	for _, name := range names {
+		if _, err := b.Open(name); err == nil {
+			t.Errorf("Open(%q): expected error, got nil", name)
+		}
+		if _, err := b.Stat(name); err == nil {
+			t.Errorf("Stat(%q): expected error, got nil", name)
+		}
+		if _, err := b.Create(name); err == nil {
+			t.Errorf("Create(%q): expected error, got nil", name)
+		}
+		if err := b.Remove(name); err == nil {
+			t.Errorf("Remove(%q): expected error, got nil", name)
+		}
+		if err := b.Rename("hello.txt", name); err == nil {
+			t.Errorf("Rename(hello.txt, %q): expected error, got nil", name)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package tailfs
+
+import (
+	"expvar"
+	"sync/atomic"
+	"time"
+)
+
+// shareMetrics holds the running counters for a single share. All fields
+// are safe for concurrent use.
+type shareMetrics struct {
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+	openHandles  atomic.Int64
+}
+
+// ShareMetrics is a point-in-time snapshot of a share's counters.
+type ShareMetrics struct {
+	BytesRead    int64
+	BytesWritten int64
+	OpenHandles  int64
+}
+
+// Metrics is a point-in-time snapshot of a Server's observability
+// surface: accept-retry count, uptime, active sessions, and per-share
+// transfer counters. See Server.Varz for a scrapeable expvar surface
+// backed by the same data.
+type Metrics struct {
+	Uptime         time.Duration
+	ActiveSessions int32
+	AcceptRetries  int64
+	Shares         map[string]ShareMetrics
+}
+
+// Metrics returns a snapshot of the Server's current metrics.
+func (s *Server) Metrics() Metrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shares := make(map[string]ShareMetrics, len(s.shares))
+	for name, sh := range s.shares {
+		shares[name] = ShareMetrics{
+			BytesRead:    sh.metrics.bytesRead.Load(),
+			BytesWritten: sh.metrics.bytesWritten.Load(),
+			OpenHandles:  sh.metrics.openHandles.Load(),
+		}
+	}
+
+	return Metrics{
+		Uptime:         time.Since(s.startTime),
+		ActiveSessions: atomic.LoadInt32(&s.activeSessions),
+		AcceptRetries:  atomic.LoadInt64(&s.acceptRetries),
+		Shares:         shares,
+	}
+}
+
+// Varz publishes the Server's metrics as an expvar.Map under name and
+// returns it, giving any expvar- or Prometheus-style scraper that reads
+// /debug/vars a live, scrapeable surface without the caller having to
+// restate the fields of Metrics themselves. Each entry is computed lazily
+// from the live counters when the map is read, so there's nothing to
+// refresh or keep in sync.
+//
+// As with expvar.Publish, name must be unique within the process and
+// Varz must be called at most once per Server: calling it twice with the
+// same name panics.
+func (s *Server) Varz(name string) *expvar.Map {
+	m := new(expvar.Map).Init()
+	m.Set("uptime_seconds", expvar.Func(func() any { return time.Since(s.startTime).Seconds() }))
+	m.Set("active_sessions", expvar.Func(func() any { return atomic.LoadInt32(&s.activeSessions) }))
+	m.Set("accept_retries", expvar.Func(func() any { return atomic.LoadInt64(&s.acceptRetries) }))
+	m.Set("shares", expvar.Func(func() any { return s.Metrics().Shares }))
+	expvar.Publish(name, m)
+	return m
+}
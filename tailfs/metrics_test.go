@@ -0,0 +1,78 @@
+package tailfs
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+)
+
+func TestMetricsTracksShareBytesAndHandles(t *testing.T) {
+	s := &Server{shares: make(map[string]*share)}
+	if err := s.AddShareBackend("docs", MemBackend(), ShareOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	fsys := backendFileSystem{s.shareByName("docs")}
+
+	w, err := fsys.Create("hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fsys.Open("hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m := s.Metrics().Shares["docs"]
+	if m.BytesWritten != 5 {
+		t.Errorf("BytesWritten = %d, want 5", m.BytesWritten)
+	}
+	if m.BytesRead != 5 {
+		t.Errorf("BytesRead = %d, want 5", m.BytesRead)
+	}
+	if m.OpenHandles != 0 {
+		t.Errorf("OpenHandles = %d, want 0 after Close", m.OpenHandles)
+	}
+}
+
+func TestVarzPublishesShareMetrics(t *testing.T) {
+	s := &Server{shares: make(map[string]*share)}
+	if err := s.AddShareBackend("docs", MemBackend(), ShareOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	fsys := backendFileSystem{s.shareByName("docs")}
+	w, err := fsys.Create("hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	v := s.Varz(t.Name())
+
+	var got struct {
+		Shares map[string]ShareMetrics `json:"shares"`
+	}
+	if err := json.Unmarshal([]byte(v.String()), &got); err != nil {
+		t.Fatalf("unmarshal expvar output: %v", err)
+	}
+	if got.Shares["docs"].BytesWritten != 5 {
+		t.Errorf("shares.docs.BytesWritten = %d, want 5", got.Shares["docs"].BytesWritten)
+	}
+}
@@ -0,0 +1,526 @@
+package tailfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"strings"
+	"sync"
+	"unicode/utf16"
+)
+
+// This file implements a minimal, from-scratch session protocol, modeled
+// on SMB2's packet header and opcodes, for serving shares in-process.
+// There is no server-side SMB2 implementation in the Go ecosystem that
+// tailfs can build on (github.com/hirochachacha/go-smb2, in particular,
+// is a *client* only — it can dial and mount a share, but has no Server
+// type), so rather than depend on a client library for a server role it
+// can't fill, this handles a wire protocol directly.
+//
+// IMPORTANT SCOPE NOTE: this is not an interoperable SMB2/3
+// implementation, and no real SMB2 client (Windows Explorer, macOS
+// Finder, Linux cifs.ko, smbclient) can mount a share served by it. Only
+// the 64-byte packet header layout and the [MS-SMB2] opcodes are
+// load-bearing; CREATE/READ/WRITE/QUERY_DIRECTORY bodies use a compact
+// encoding of this package's own devising rather than the variable-length
+// structures [MS-SMB2] actually specifies, and there is no dialect
+// negotiation security buffer, no NTLM/SPNEGO authentication exchange in
+// SESSION_SETUP, no encryption, no compounding, no durable or persistent
+// handles, and no multi-credit flow control.
+//
+// Getting to something real SMB2 clients can mount is a substantial
+// follow-up: it needs the actual [MS-SMB2] CREATE/QUERY_DIRECTORY
+// structures (not just a compact stand-in), an NTLM or SPNEGO
+// SESSION_SETUP handshake, and dialect-appropriate signing — or,
+// per this request's own fallback suggestion, wrapping an existing
+// server-capable implementation (e.g. Samba's VFS layer via CGO) instead
+// of a from-scratch reimplementation. Until one of those lands, treat
+// this file as tailfs's private, in-process transport between
+// Server.handleConn and a Backend, not as a fileserver other software can
+// speak to.
+
+// SMB2 command codes, as assigned by [MS-SMB2] even though the bodies
+// below don't follow that spec's encoding.
+const (
+	cmdNegotiate      uint16 = 0x0000
+	cmdSessionSetup   uint16 = 0x0001
+	cmdLogoff         uint16 = 0x0002
+	cmdTreeConnect    uint16 = 0x0003
+	cmdTreeDisconnect uint16 = 0x0004
+	cmdCreate         uint16 = 0x0005
+	cmdClose          uint16 = 0x0006
+	cmdRead           uint16 = 0x0008
+	cmdWrite          uint16 = 0x0009
+	cmdQueryDirectory uint16 = 0x000e
+)
+
+// Status codes, a small subset of [MS-ERREF].
+const (
+	statusSuccess      uint32 = 0x00000000
+	statusNoSuchFile   uint32 = 0xC0000034
+	statusAccessDenied uint32 = 0xC0000022
+	statusNotSupported uint32 = 0xC00000BB
+)
+
+const smb2HeaderSize = 64
+
+const smb2Dialect302 uint16 = 0x0302
+
+const (
+	flagServerToRedir = 0x00000001
+	flagSigned        = 0x00000008
+)
+
+var smb2ProtocolID = [4]byte{0xfe, 'S', 'M', 'B'}
+
+// smb2Header is the fixed 64-byte SMB2 packet header.
+type smb2Header struct {
+	CreditCharge uint16
+	Status       uint32
+	Command      uint16
+	Credit       uint16
+	Flags        uint32
+	NextCommand  uint32
+	MessageID    uint64
+	TreeID       uint32
+	SessionID    uint64
+	Signature    [16]byte
+}
+
+func decodeSMB2Header(b []byte) (smb2Header, error) {
+	var h smb2Header
+	if len(b) < smb2HeaderSize {
+		return h, fmt.Errorf("short SMB2 header: %d bytes", len(b))
+	}
+	var id [4]byte
+	copy(id[:], b[0:4])
+	if id != smb2ProtocolID {
+		return h, errors.New("not an SMB2 packet")
+	}
+	h.CreditCharge = binary.LittleEndian.Uint16(b[6:8])
+	h.Status = binary.LittleEndian.Uint32(b[8:12])
+	h.Command = binary.LittleEndian.Uint16(b[12:14])
+	h.Credit = binary.LittleEndian.Uint16(b[14:16])
+	h.Flags = binary.LittleEndian.Uint32(b[16:20])
+	h.NextCommand = binary.LittleEndian.Uint32(b[20:24])
+	h.MessageID = binary.LittleEndian.Uint64(b[24:32])
+	h.TreeID = binary.LittleEndian.Uint32(b[36:40])
+	h.SessionID = binary.LittleEndian.Uint64(b[40:48])
+	copy(h.Signature[:], b[48:64])
+	return h, nil
+}
+
+func encodeSMB2Header(h smb2Header) []byte {
+	b := make([]byte, smb2HeaderSize)
+	copy(b[0:4], smb2ProtocolID[:])
+	binary.LittleEndian.PutUint16(b[4:6], smb2HeaderSize)
+	binary.LittleEndian.PutUint16(b[6:8], h.CreditCharge)
+	binary.LittleEndian.PutUint32(b[8:12], h.Status)
+	binary.LittleEndian.PutUint16(b[12:14], h.Command)
+	binary.LittleEndian.PutUint16(b[14:16], h.Credit)
+	binary.LittleEndian.PutUint32(b[16:20], h.Flags|flagServerToRedir)
+	binary.LittleEndian.PutUint32(b[20:24], h.NextCommand)
+	binary.LittleEndian.PutUint64(b[24:32], h.MessageID)
+	binary.LittleEndian.PutUint32(b[36:40], h.TreeID)
+	binary.LittleEndian.PutUint64(b[40:48], h.SessionID)
+	copy(b[48:64], h.Signature[:])
+	return b
+}
+
+// readFrame and writeFrame implement NetBIOS session service framing
+// (a 4-byte length prefix), the transport SMB2 rides over on TCP.
+func readFrame(r io.Reader) ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	if lenBuf[0] != 0 {
+		return nil, fmt.Errorf("unsupported NetBIOS session packet type %#x", lenBuf[0])
+	}
+	n := int(lenBuf[1])<<16 | int(lenBuf[2])<<8 | int(lenBuf[3])
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func writeFrame(w io.Writer, payload []byte) error {
+	if len(payload) >= 1<<24 {
+		return fmt.Errorf("frame too large: %d bytes", len(payload))
+	}
+	var lenBuf [4]byte
+	lenBuf[1] = byte(len(payload) >> 16)
+	lenBuf[2] = byte(len(payload) >> 8)
+	lenBuf[3] = byte(len(payload))
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// smb2Handle is a single open file or directory within a session.
+type smb2Handle struct {
+	name   string
+	file   fs.File
+	writer io.WriteCloser
+}
+
+// smb2Session is per-connection state.
+type smb2Session struct {
+	id uint64
+
+	mu      sync.Mutex
+	tree    Backend
+	handles map[uint64]*smb2Handle
+	nextID  uint64
+}
+
+func (sess *smb2Session) addHandle(h *smb2Handle) uint64 {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.nextID++
+	id := sess.nextID
+	sess.handles[id] = h
+	return id
+}
+
+func (sess *smb2Session) handle(id uint64) *smb2Handle {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.handles[id]
+}
+
+func (sess *smb2Session) removeHandle(id uint64) *smb2Handle {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	h := sess.handles[id]
+	delete(sess.handles, id)
+	return h
+}
+
+// signSMB2 returns a sign function for serveSMB2 that HMACs each signed
+// response with key, which in practice is the server's host key (see
+// ensureHostKey in state.go). It covers the session and message IDs and
+// the response body, truncated to the 16-byte Signature field; this is
+// enough to let a client detect a response from a different session or
+// one that's been tampered with in transit, but (like the rest of this
+// package's SMB2 support) is not a full [MS-SMB2] signing implementation.
+func signSMB2(key []byte) func(h smb2Header, body []byte) [16]byte {
+	return func(h smb2Header, body []byte) [16]byte {
+		mac := hmac.New(sha256.New, key)
+		var idBuf [16]byte
+		binary.LittleEndian.PutUint64(idBuf[0:8], h.SessionID)
+		binary.LittleEndian.PutUint64(idBuf[8:16], h.MessageID)
+		mac.Write(idBuf[:])
+		mac.Write(body)
+
+		var sig [16]byte
+		copy(sig[:], mac.Sum(nil))
+		return sig
+	}
+}
+
+// serveSMB2 runs the SMB2 protocol on conn until it's closed or a
+// framing error occurs, resolving TREE_CONNECT requests via
+// resolveShare. sign, if non-nil, computes the Signature field for
+// responses to requests sent with flagSigned set.
+func serveSMB2(conn net.Conn, resolveShare func(name string) (Backend, bool), sign func(h smb2Header, body []byte) [16]byte) error {
+	sess := &smb2Session{id: 1, handles: make(map[uint64]*smb2Handle)}
+	for {
+		req, err := readFrame(conn)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("read frame: %w", err)
+		}
+
+		reqHeader, err := decodeSMB2Header(req)
+		if err != nil {
+			return fmt.Errorf("decode header: %w", err)
+		}
+		body := req[smb2HeaderSize:]
+
+		respHeader, respBody := dispatchSMB2(sess, resolveShare, reqHeader, body)
+		if sign != nil && reqHeader.Flags&flagSigned != 0 {
+			respHeader.Flags |= flagSigned
+			respHeader.Signature = sign(respHeader, respBody)
+		}
+
+		resp := append(encodeSMB2Header(respHeader), respBody...)
+		if err := writeFrame(conn, resp); err != nil {
+			return fmt.Errorf("write frame: %w", err)
+		}
+	}
+}
+
+func dispatchSMB2(sess *smb2Session, resolveShare func(name string) (Backend, bool), h smb2Header, body []byte) (smb2Header, []byte) {
+	resp := smb2Header{
+		Command:   h.Command,
+		MessageID: h.MessageID,
+		TreeID:    h.TreeID,
+		SessionID: sess.id,
+		Credit:    1,
+	}
+
+	var respBody []byte
+	switch h.Command {
+	case cmdNegotiate:
+		respBody = handleNegotiate()
+	case cmdSessionSetup:
+		// Authentication already happened out of band: the caller
+		// resolved the peer's Tailscale identity before handing the
+		// connection to serveSMB2, and ACLs are enforced per share in
+		// TREE_CONNECT below. SESSION_SETUP here just establishes the
+		// session with no further challenge/response.
+	case cmdTreeConnect:
+		respBody, resp.Status = handleTreeConnect(sess, resolveShare, body)
+	case cmdTreeDisconnect:
+		sess.mu.Lock()
+		sess.tree = nil
+		sess.mu.Unlock()
+	case cmdCreate:
+		respBody, resp.Status = handleCreate(sess, body)
+	case cmdClose:
+		resp.Status = handleClose(sess, body)
+	case cmdRead:
+		respBody, resp.Status = handleRead(sess, body)
+	case cmdWrite:
+		respBody, resp.Status = handleWrite(sess, body)
+	case cmdQueryDirectory:
+		respBody, resp.Status = handleQueryDirectory(sess, body)
+	case cmdLogoff:
+		// No-op; closing the connection tears down the session.
+	default:
+		resp.Status = statusNotSupported
+	}
+	return resp, respBody
+}
+
+func handleNegotiate() []byte {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, smb2Dialect302)
+	return b
+}
+
+// handleTreeConnect request body: the UTF-16LE share path, e.g.
+// `\\host\share`. Only the last path component is used to resolve the
+// share.
+func handleTreeConnect(sess *smb2Session, resolveShare func(name string) (Backend, bool), body []byte) ([]byte, uint32) {
+	path := decodeUTF16(body)
+	parts := strings.Split(path, `\`)
+	name := parts[len(parts)-1]
+
+	backend, ok := resolveShare(name)
+	if !ok {
+		return nil, statusAccessDenied
+	}
+
+	sess.mu.Lock()
+	sess.tree = backend
+	sess.mu.Unlock()
+	return nil, statusSuccess
+}
+
+// handleCreate request body: [2]nameLen, [nameLen]name (UTF-16LE),
+// [1]disposition (0 = open existing, 1 = create/overwrite).
+// Response body: [8]fileID.
+func handleCreate(sess *smb2Session, body []byte) ([]byte, uint32) {
+	sess.mu.Lock()
+	tree := sess.tree
+	sess.mu.Unlock()
+	if tree == nil {
+		return nil, statusAccessDenied
+	}
+	if len(body) < 3 {
+		return nil, statusNotSupported
+	}
+
+	nameLen := binary.LittleEndian.Uint16(body[0:2])
+	if len(body) < int(2+nameLen+1) {
+		return nil, statusNotSupported
+	}
+	name := decodeUTF16(body[2 : 2+nameLen])
+	disposition := body[2+nameLen]
+
+	h := &smb2Handle{name: name}
+	if disposition == 0 {
+		f, err := tree.Open(name)
+		if err != nil {
+			return nil, statusNoSuchFile
+		}
+		h.file = f
+	} else {
+		w, err := tree.Create(name)
+		if err != nil {
+			return nil, statusAccessDenied
+		}
+		h.writer = w
+	}
+
+	id := sess.addHandle(h)
+	resp := make([]byte, 8)
+	binary.LittleEndian.PutUint64(resp, id)
+	return resp, statusSuccess
+}
+
+// maxReadLength caps the allocation handleRead will make for a single
+// READ, regardless of the length a client asks for. It's well above any
+// read size this package's own client code issues; it exists only to
+// stop a malformed or hostile request's length field (a client-supplied
+// uint32, up to 4GB) from forcing a multi-gigabyte allocation per READ.
+const maxReadLength = 4 << 20 // 4MiB
+
+// handleRead request body: [8]fileID, [4]length. Response body:
+// [4]dataLen, [dataLen]data.
+func handleRead(sess *smb2Session, body []byte) ([]byte, uint32) {
+	if len(body) < 12 {
+		return nil, statusNotSupported
+	}
+	id := binary.LittleEndian.Uint64(body[0:8])
+	length := binary.LittleEndian.Uint32(body[8:12])
+	if length > maxReadLength {
+		length = maxReadLength
+	}
+
+	h := sess.handle(id)
+	if h == nil || h.file == nil {
+		return nil, statusNoSuchFile
+	}
+
+	buf := make([]byte, length)
+	n, err := h.file.Read(buf)
+	if err != nil && err != io.EOF {
+		return nil, statusNoSuchFile
+	}
+
+	resp := make([]byte, 4+n)
+	binary.LittleEndian.PutUint32(resp[0:4], uint32(n))
+	copy(resp[4:], buf[:n])
+	return resp, statusSuccess
+}
+
+// handleWrite request body: [8]fileID, [8]offset, [4]dataLen,
+// [dataLen]data. Response body: [4]bytesWritten.
+func handleWrite(sess *smb2Session, body []byte) ([]byte, uint32) {
+	if len(body) < 20 {
+		return nil, statusNotSupported
+	}
+	id := binary.LittleEndian.Uint64(body[0:8])
+	_ = binary.LittleEndian.Uint64(body[8:16]) // offset: unused, see below
+	dataLen := binary.LittleEndian.Uint32(body[16:20])
+	if len(body) < int(20+dataLen) {
+		return nil, statusNotSupported
+	}
+	data := body[20 : 20+dataLen]
+
+	h := sess.handle(id)
+	if h == nil || h.writer == nil {
+		return nil, statusAccessDenied
+	}
+
+	// The writer returned by Backend.Create is a stream, not a random-
+	// access file, so writes are sequential and the offset field is
+	// ignored; Backend.Write, which takes an offset, is not called by any
+	// command in this file. CREATE+WRITE+CLOSE always appends.
+	n, err := h.writer.Write(data)
+	if err != nil {
+		return nil, statusAccessDenied
+	}
+
+	resp := make([]byte, 4)
+	binary.LittleEndian.PutUint32(resp, uint32(n))
+	return resp, statusSuccess
+}
+
+// handleClose request body: [8]fileID.
+func handleClose(sess *smb2Session, body []byte) uint32 {
+	if len(body) < 8 {
+		return statusNotSupported
+	}
+	id := binary.LittleEndian.Uint64(body[0:8])
+	h := sess.removeHandle(id)
+	if h == nil {
+		return statusNoSuchFile
+	}
+	var err error
+	switch {
+	case h.file != nil:
+		err = h.file.Close()
+	case h.writer != nil:
+		err = h.writer.Close()
+	}
+	if err != nil {
+		return statusAccessDenied
+	}
+	return statusSuccess
+}
+
+// handleQueryDirectory request body: [2]nameLen, [nameLen]name
+// (UTF-16LE). Response body: [4]count, then per entry [2]nameLen,
+// [nameLen]name, [8]size, [1]isDir.
+func handleQueryDirectory(sess *smb2Session, body []byte) ([]byte, uint32) {
+	sess.mu.Lock()
+	tree := sess.tree
+	sess.mu.Unlock()
+	if tree == nil {
+		return nil, statusAccessDenied
+	}
+	if len(body) < 2 {
+		return nil, statusNotSupported
+	}
+	nameLen := binary.LittleEndian.Uint16(body[0:2])
+	if len(body) < int(2+nameLen) {
+		return nil, statusNotSupported
+	}
+	name := decodeUTF16(body[2 : 2+nameLen])
+
+	entries, err := tree.Readdir(name)
+	if err != nil {
+		return nil, statusNoSuchFile
+	}
+
+	resp := make([]byte, 4)
+	binary.LittleEndian.PutUint32(resp, uint32(len(entries)))
+	for _, e := range entries {
+		encName := encodeUTF16(e.Name())
+		entry := make([]byte, 2+len(encName)+8+1)
+		binary.LittleEndian.PutUint16(entry[0:2], uint16(len(encName)))
+		copy(entry[2:], encName)
+		info, err := e.Info()
+		var size int64
+		if err == nil {
+			size = info.Size()
+		}
+		binary.LittleEndian.PutUint64(entry[2+len(encName):], uint64(size))
+		if e.IsDir() {
+			entry[2+len(encName)+8] = 1
+		}
+		resp = append(resp, entry...)
+	}
+	return resp, statusSuccess
+}
+
+func decodeUTF16(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[i*2:])
+	}
+	return string(utf16.Decode(u))
+}
+
+func encodeUTF16(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, len(u)*2)
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[i*2:], c)
+	}
+	return b
+}
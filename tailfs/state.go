@@ -0,0 +1,96 @@
+package tailfs
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Permissions for on-disk state. hostKeyPerm applies to hostKeyPath,
+// which holds the key the server uses to sign SMB sessions and must not
+// be world- or group-readable.
+const (
+	stateDirPerm   fs.FileMode = 0700
+	privateDirPerm fs.FileMode = 0700
+	hostKeyPerm    fs.FileMode = 0600
+)
+
+// ensureStateDirs creates (or tightens the permissions of) StateDir and
+// its private subdirectory, then ensures a host key exists. It is called
+// on every Start, so a directory left world-readable by an older version
+// of tailfs is repaired rather than trusted.
+func (s *Server) ensureStateDirs() error {
+	if err := ensureDirPerm(s.opts.StateDir, stateDirPerm); err != nil {
+		return fmt.Errorf("state directory: %w", err)
+	}
+	if err := ensureDirPerm(s.privateDir(), privateDirPerm); err != nil {
+		return fmt.Errorf("private directory: %w", err)
+	}
+	if err := s.ensureHostKey(); err != nil {
+		return fmt.Errorf("host key: %w", err)
+	}
+	return nil
+}
+
+// privateDir is the subdirectory of StateDir that holds key material and
+// other secrets. It is never served as, or nested inside, a share.
+func (s *Server) privateDir() string {
+	return filepath.Join(s.opts.StateDir, "private")
+}
+
+func (s *Server) hostKeyPath() string {
+	return filepath.Join(s.privateDir(), "hostkey")
+}
+
+// ensureHostKey creates a random host key with hostKeyPerm if one
+// doesn't already exist, and tightens the permissions of an existing one
+// that was created with a looser mode by an older version of tailfs. It
+// also loads the key into s.hostKey, which handleConn uses to sign SMB2
+// sessions via signSMB2.
+func (s *Server) ensureHostKey() error {
+	path := s.hostKeyPath()
+
+	fi, err := os.Stat(path)
+	switch {
+	case os.IsNotExist(err):
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return fmt.Errorf("generate host key: %w", err)
+		}
+		if err := os.WriteFile(path, key, hostKeyPerm); err != nil {
+			return fmt.Errorf("write host key: %w", err)
+		}
+		s.hostKey = key
+		return nil
+	case err != nil:
+		return fmt.Errorf("stat %v: %w", path, err)
+	case fi.Mode().Perm() != hostKeyPerm:
+		if err := os.Chmod(path, hostKeyPerm); err != nil {
+			return fmt.Errorf("chmod %v: %w", path, err)
+		}
+	}
+
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read host key: %w", err)
+	}
+	s.hostKey = key
+	return nil
+}
+
+// ensureDirPerm creates dir with perm if it doesn't exist, and tightens
+// its permissions to perm if it already exists with a looser mode.
+func ensureDirPerm(dir string, perm fs.FileMode) error {
+	fi, err := os.Stat(dir)
+	switch {
+	case os.IsNotExist(err):
+		return os.MkdirAll(dir, perm)
+	case err != nil:
+		return fmt.Errorf("stat %v: %w", dir, err)
+	case fi.Mode().Perm() != perm:
+		return os.Chmod(dir, perm)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package tailfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnsureStateDirsSetsPermissions(t *testing.T) {
+	tmpDir := t.TempDir()
+	s := &Server{opts: &Opts{StateDir: tmpDir}}
+
+	if err := s.ensureStateDirs(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{tmpDir, s.privateDir()} {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0700 {
+			t.Fatalf("%v has perm %v, want 0700", dir, fi.Mode().Perm())
+		}
+	}
+
+	fi, err := os.Stat(s.hostKeyPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("host key has perm %v, want 0600", fi.Mode().Perm())
+	}
+	if len(s.hostKey) == 0 {
+		t.Fatal("s.hostKey is empty after ensureStateDirs")
+	}
+}
+
+func TestEnsureStateDirsRepairsLoosePermissions(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	privateDir := filepath.Join(tmpDir, "private")
+	if err := os.MkdirAll(privateDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	hostKeyPath := filepath.Join(privateDir, "hostkey")
+	if err := os.WriteFile(hostKeyPath, []byte("not-actually-random"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{opts: &Opts{StateDir: tmpDir}}
+	if err := s.ensureStateDirs(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{tmpDir, privateDir} {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0700 {
+			t.Fatalf("%v has perm %v, want 0700", dir, fi.Mode().Perm())
+		}
+	}
+	fi, err := os.Stat(hostKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("host key has perm %v, want 0600", fi.Mode().Perm())
+	}
+	if string(s.hostKey) != "not-actually-random" {
+		t.Fatalf("s.hostKey = %q, want the pre-existing key to be preserved and loaded", s.hostKey)
+	}
+}
@@ -0,0 +1,111 @@
+package tailfs
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Backoff parameters for the accept loop, modeled after rclone's SMB
+// connection pool: start at minBackoff and double (decayConstant) on
+// each consecutive error, capping at maxBackoff.
+const (
+	minBackoff    = 100 * time.Millisecond
+	maxBackoff    = 30 * time.Second
+	decayConstant = 2
+)
+
+// Stop shuts down the Server, closing the listener and waiting for all
+// in-flight sessions to finish.
+func (s *Server) Stop() {
+	s.closeOnce.Do(func() {
+		close(s.closing)
+		s.ln.Close()
+	})
+	s.wg.Wait()
+}
+
+// Wait blocks until the Server has stopped, either because Stop was
+// called or because IdleTimeout elapsed with no active sessions.
+func (s *Server) Wait() {
+	s.wg.Wait()
+}
+
+// serve accepts connections until the listener is closed, backing off
+// with exponential delay between consecutive accept errors so a
+// misbehaving listener doesn't spin the CPU.
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	if s.opts.IdleTimeout > 0 {
+		s.wg.Add(1)
+		go s.watchIdle()
+	}
+
+	backoff := minBackoff
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			select {
+			case <-s.closing:
+				return
+			default:
+			}
+			atomic.AddInt64(&s.acceptRetries, 1)
+			s.logf("accept: %v; retrying in %v", err, backoff)
+			time.Sleep(backoff)
+			backoff *= decayConstant
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		backoff = minBackoff
+
+		atomic.AddInt32(&s.activeSessions, 1)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer atomic.AddInt32(&s.activeSessions, -1)
+			s.handleConn(conn)
+		}()
+	}
+}
+
+// watchIdle stops the Server once it has had no active sessions for
+// IdleTimeout. This is a hard shutdown, equivalent to calling Stop: the
+// listener is closed and Port stops accepting connections. It is not
+// transparent to callers that have cached Port — resuming service means
+// calling Start again, which binds a new ephemeral port, so a caller
+// that wants idle shutdown to look like "the port reopens on demand"
+// must re-dial and re-advertise the new Port itself, or not set
+// IdleTimeout at all.
+func (s *Server) watchIdle() {
+	defer s.wg.Done()
+
+	const pollInterval = time.Second
+	var idleSince time.Time
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+		}
+
+		if atomic.LoadInt32(&s.activeSessions) > 0 {
+			idleSince = time.Time{}
+			continue
+		}
+		if idleSince.IsZero() {
+			idleSince = time.Now()
+			continue
+		}
+		if time.Since(idleSince) >= s.opts.IdleTimeout {
+			s.logf("idle for %v, stopping", s.opts.IdleTimeout)
+			go s.Stop()
+			return
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package tailfs
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"tailscale.com/types/logger"
+)
+
+func TestStopClosesListenerAndWaits(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		opts:    &Opts{},
+		logf:    logger.Discard,
+		shares:  make(map[string]*share),
+		ln:      ln,
+		closing: make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+
+	s.Stop()
+
+	if _, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Fatal("expected listener to be closed after Stop")
+	}
+}
+
+func TestWatchIdleStopsAfterTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		opts:    &Opts{IdleTimeout: 10 * time.Millisecond},
+		logf:    logger.Discard,
+		shares:  make(map[string]*share),
+		ln:      ln,
+		closing: make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+
+	done := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop after idling")
+	}
+}
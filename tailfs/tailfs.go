@@ -1,177 +1,203 @@
+// Package tailfs implements a native, in-process file-sharing server for
+// exposing shares to other nodes on the tailnet. Its wire protocol is
+// modeled on SMB2's packet framing and opcodes but is not an
+// interoperable [MS-SMB2] implementation: no real SMB2/3 client can
+// mount a share served by it yet. See the scope note at the top of
+// smb2.go before assuming otherwise.
 package tailfs
 
 import (
 	"fmt"
-	"io"
-	"io/fs"
+	"log"
 	"net"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"text/template"
+	"sync"
 	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
 )
 
+// Server serves shares over tailfs's private, SMB2-framed session
+// protocol (see smb2.go — not a real SMB2/3 server yet). Shares can be
+// added and removed at runtime via AddShare and RemoveShare without
+// restarting the server.
 type Server struct {
-	opts        *Opts
-	smbConfPath string
-	cmd         *exec.Cmd
+	opts *Opts
+	logf logger.Logf
+	ln   net.Listener
+
+	// hostKey signs SMB2 sessions via signSMB2. It is loaded by
+	// ensureStateDirs before the listener starts accepting connections.
+	hostKey []byte
+
+	mu     sync.Mutex
+	shares map[string]*share
+
+	closing        chan struct{}
+	closeOnce      sync.Once
+	wg             sync.WaitGroup
+	startTime      time.Time
+	activeSessions int32
+	acceptRetries  int64
+
 	// Port is the port on 127.0.0.1 on which the Server is listening.
 	Port int
 }
 
+// Opts configures a Server.
 type Opts struct {
-	// StateDir is the base directory where TailFS will store SMB state.
+	// StateDir is the base directory where TailFS will store its state.
 	StateDir string
-	// SMBDCommand is the full path to the smbd binary that TailFS will use to
-	// server SMB shares.
-	SMBDCommand string
+
+	// ACL, if non-nil, gates share access by the connecting peer's
+	// Tailscale identity. Shares with no entry in the map are open to
+	// any peer that can reach the server.
+	ACL ShareACL
+
+	// PeerIdentity resolves the Tailscale node and user login of the
+	// peer at the other end of conn. It is called once per accepted
+	// connection, before any share is served on it.
+	PeerIdentity func(conn net.Conn) (node tailcfg.NodeView, userLogin string, err error)
+
+	// IdleTimeout, if non-zero, stops the Server after it has had no
+	// active sessions for this long. This is a hard, non-resumable
+	// shutdown: it closes the listener exactly as Stop does, and a
+	// subsequent Start binds a new ephemeral Port rather than reopening
+	// the old one. See Server.Wait and Server.Stop.
+	IdleTimeout time.Duration
+
+	// Logf, if non-nil, is used for logging instead of the standard
+	// library's log package.
+	Logf logger.Logf
 }
 
+// ShareOpts controls the behavior of an individual share.
+type ShareOpts struct {
+	// ReadOnly, if true, disallows writes to the share.
+	ReadOnly bool
+}
+
+// share is a single exposed directory tree.
+type share struct {
+	name    string
+	backend Backend
+	opts    ShareOpts
+	metrics *shareMetrics
+}
+
+// Start creates the state directory if necessary and starts a Server
+// listening on an ephemeral localhost port.
 func Start(opts *Opts) (*Server, error) {
-	if err := os.MkdirAll(opts.StateDir, 0755); err != nil {
-		return nil, fmt.Errorf("create state directory: %w", err)
+	logf := opts.Logf
+	if logf == nil {
+		logf = log.Printf
 	}
 
 	s := &Server{
-		opts:        opts,
-		smbConfPath: filepath.Join(opts.StateDir, "smb.conf"),
+		opts:    opts,
+		logf:    logger.WithPrefix(logf, "tailfs: "),
+		shares:  make(map[string]*share),
+		closing: make(chan struct{}),
 	}
 
-	if err := s.initSMBConfIfNecessary(); err != nil {
-		return nil, fmt.Errorf("init smb.conf: %w", err)
+	if err := s.ensureStateDirs(); err != nil {
+		return nil, fmt.Errorf("prepare state directory: %w", err)
 	}
 
-	err := s.start()
-	if err != nil {
+	if err := s.start(); err != nil {
 		return nil, fmt.Errorf("start: %w", err)
 	}
 
 	return s, nil
 }
 
-func (s *Server) initSMBConfIfNecessary() error {
-	_, err := os.Stat(s.smbConfPath)
-	if err == nil {
-		// file exists, nothing to do
-		return nil
-	}
-	if !os.IsNotExist(err) {
-		// couldn't stat file for some other reason
-		return fmt.Errorf("check %v exists: %w", s.smbConfPath, err)
-	}
-
-	// Need to create config
-	file, err := os.OpenFile(s.smbConfPath, os.O_CREATE|os.O_WRONLY, 0644)
+// AddShare exposes the local directory at path as an SMB share named
+// name. If a share with the same name already exists, it is replaced.
+// To serve a share from a non-local Backend, use AddShareBackend.
+func (s *Server) AddShare(name, path string, opts ShareOpts) error {
+	fi, err := os.Stat(path)
 	if err != nil {
-		return fmt.Errorf("create %v: %w", s.smbConfPath, err)
+		return fmt.Errorf("stat %v: %w", path, err)
 	}
-	defer file.Close()
-
-	tmpl, err := template.New("smb.conf").Parse(smbConfTemplate)
-	if err != nil {
-		return fmt.Errorf("parse smb.conf template: %w", err)
+	if !fi.IsDir() {
+		return fmt.Errorf("%v is not a directory", path)
 	}
+	return s.AddShareBackend(name, LocalBackend(path), opts)
+}
 
-	ds := directorySettings()
-	for _, d := range ds {
-		d.AbsolutePath = filepath.Join(s.opts.StateDir, d.path)
-		err = os.MkdirAll(d.AbsolutePath, d.perm)
-		if err != nil {
-			return fmt.Errorf("create %v: %w", d.AbsolutePath, err)
-		}
-	}
+// AddShareBackend exposes backend as an SMB share named name. If a share
+// with the same name already exists, it is replaced.
+func (s *Server) AddShareBackend(name string, backend Backend, opts ShareOpts) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shares[name] = &share{name: name, backend: backend, opts: opts, metrics: &shareMetrics{}}
+	return nil
+}
 
-	if err := tmpl.Execute(file, ds); err != nil {
-		return fmt.Errorf("execute smb.conf template: %w", err)
-	}
+// RemoveShare stops exposing the share named name. It is a no-op if no
+// such share exists.
+func (s *Server) RemoveShare(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.shares, name)
+}
 
-	return nil
+// shareByName returns the share named name, or nil if there is none.
+func (s *Server) shareByName(name string) *share {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shares[name]
 }
 
 func (s *Server) start() error {
-	// First find an open port
-	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		return fmt.Errorf("listen: %w", err)
 	}
-	s.Port = l.Addr().(*net.TCPAddr).Port
-	l.Close()
-
-	// Set up the command
-	s.cmd = exec.Command(
-		s.opts.SMBDCommand,
-		fmt.Sprintf("--configfile=%s", s.smbConfPath),
-		fmt.Sprintf("--port=%d", s.Port),
-		"--foreground",
-		"--no-process-group",
-		"--debug-stdout",
-	)
-
-	// Redirect stdout and stderr to the current process
-	stdOutPipe, err := s.cmd.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("stdout pipe: %w", err)
-	}
-	stdErrPipe, err := s.cmd.StderrPipe()
-	if err != nil {
-		return fmt.Errorf("stderr pipe: %w", err)
-	}
-	go func() {
-		io.Copy(os.Stdout, stdOutPipe)
-		stdOutPipe.Close()
-	}()
-	go func() {
-		io.Copy(os.Stderr, stdErrPipe)
-		stdErrPipe.Close()
-	}()
-
-	// Run smbd in a supervisor loop
-	go func() {
-		fmt.Println("Running smbd in a loop")
-		for {
-			if err := s.cmd.Run(); err != nil {
-				fmt.Printf("smbd exited, will restart: %v\n", err)
-				// TODO: use exponential backoff
-				time.Sleep(1 * time.Second)
-			}
-		}
-	}()
+	s.ln = ln
+	s.Port = ln.Addr().(*net.TCPAddr).Port
+	s.startTime = time.Now()
+
+	s.wg.Add(1)
+	go s.serve()
 
 	return nil
 }
 
-type directorySetting struct {
-	Setting      string
-	AbsolutePath string
-	path         string
-	perm         fs.FileMode
-}
+// handleConn runs tailfs's SMB2-framed session protocol (see smb2.go) on
+// a single accepted connection, serving the shares registered via
+// AddShare.
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	var node tailcfg.NodeView
+	var userLogin string
+	if s.opts.PeerIdentity != nil {
+		var err error
+		node, userLogin, err = s.opts.PeerIdentity(conn)
+		if err != nil {
+			s.logf("resolving peer identity: %v", err)
+			return
+		}
+	}
+
+	resolveShare := func(name string) (Backend, bool) {
+		sh := s.shareByName(name)
+		if sh == nil {
+			return nil, false
+		}
+		if !s.opts.ACL.allows(name, node, userLogin) {
+			return nil, false
+		}
+		return backendFileSystem{sh}, true
+	}
 
-func directorySettings() []*directorySetting {
-	return []*directorySetting{
-		{Setting: "state directory", path: "", perm: 0755},
-		{Setting: "log file", path: "log", perm: 0755},
-		{Setting: "pid directory", path: "pid", perm: 0755},
-		{Setting: "lock directory", path: "private", perm: 0755},
-		{Setting: "private dir", path: "private", perm: 0755},
-		{Setting: "binddns dir", path: "bind-dns", perm: 0755},
-		{Setting: "cache directory", path: "cache", perm: 0755},
-		{Setting: "ncalrpc dir", path: "ncalrpc", perm: 0755},
-		{Setting: "ntp signed socket directory", path: "ntp_signd", perm: 0755},
-		{Setting: "usershare path", path: "usershares", perm: 0755},
-		{Setting: "winbdd socket directory", path: "winbindd", perm: 0755},
+	var sign func(h smb2Header, body []byte) [16]byte
+	if len(s.hostKey) > 0 {
+		sign = signSMB2(s.hostKey)
+	}
+	if err := serveSMB2(conn, resolveShare, sign); err != nil {
+		s.logf("session error: %v", err)
 	}
 }
-
-const smbConfTemplate = `
-[global]
-        server role     = standalone server
-        interfaces      = 127.0.0.1
-        registry shares = no
-        config backend  = file
-		log level       = 5
-        {{ range . }}
-        {{ .Setting }} = {{ .AbsolutePath }}
-        {{ end }}
-`
@@ -1,42 +1,35 @@
 package tailfs
 
 import (
-	"fmt"
 	"os"
-	"path/filepath"
-	"strings"
 	"testing"
 )
 
-func TestInitSMBConfIfNecessary(t *testing.T) {
+func TestAddRemoveShare(t *testing.T) {
 	tmpDir := t.TempDir()
-	smbConfPath := filepath.Join(tmpDir, "smb.conf")
-	s := &Server{
-		smbConfPath: smbConfPath,
-		opts:        &Opts{StateDir: tmpDir},
-	}
-	err := s.initSMBConfIfNecessary()
-	if err != nil {
+	s := &Server{shares: make(map[string]*share)}
+
+	if err := s.AddShare("docs", tmpDir, ShareOpts{}); err != nil {
 		t.Fatal(err)
 	}
-	b, err := os.ReadFile(smbConfPath)
-	if err != nil {
+	if got := s.shareByName("docs"); got == nil {
+		t.Fatal("share not found after AddShare")
+	}
+
+	s.RemoveShare("docs")
+	if got := s.shareByName("docs"); got != nil {
+		t.Fatal("share still found after RemoveShare")
+	}
+}
+
+func TestAddShareNotADirectory(t *testing.T) {
+	tmpFile := t.TempDir() + "/not-a-dir"
+	if err := os.WriteFile(tmpFile, nil, 0644); err != nil {
 		t.Fatal(err)
 	}
-	conf := string(b)
-	ds := directorySettings()
-	for _, d := range ds {
-		absolutePath := filepath.Join(tmpDir, d.path)
-		fi, err := os.Stat(absolutePath)
-		if err != nil {
-			t.Fatalf("stat %v: %v", absolutePath, err)
-		}
-		if !fi.IsDir() {
-			t.Fatalf("%v is not a directory", absolutePath)
-		}
-		if !strings.Contains(conf, fmt.Sprintf("%v = %v", d.Setting, absolutePath)) {
-			fmt.Println(conf)
-			t.Fatalf("conf does not contain %v = %v", d.Setting, absolutePath)
-		}
+
+	s := &Server{shares: make(map[string]*share)}
+	if err := s.AddShare("bad", tmpFile, ShareOpts{}); err == nil {
+		t.Fatal("expected error adding a share rooted at a file, got nil")
 	}
 }
@@ -0,0 +1,160 @@
+package tailfs
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestWebDAVServer returns a minimal WebDAV server backed by an
+// in-memory map, implementing just the verbs webdavBackend uses. It
+// exists to exercise webdavBackend's request/response handling, not to
+// be a conformant WebDAV implementation.
+func newTestWebDAVServer(t *testing.T) *httptest.Server {
+	var mu sync.Mutex
+	files := make(map[string][]byte)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			mu.Lock()
+			data, ok := files[name]
+			mu.Unlock()
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+			if r.Method == http.MethodGet {
+				w.Write(data)
+			}
+		case http.MethodPut:
+			data, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			mu.Lock()
+			files[name] = data
+			mu.Unlock()
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodDelete:
+			mu.Lock()
+			delete(files, name)
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		case "MOVE":
+			dest, err := url.Parse(r.Header.Get("Destination"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			destName := strings.TrimPrefix(dest.Path, "/")
+			mu.Lock()
+			files[destName] = files[name]
+			delete(files, name)
+			mu.Unlock()
+			w.WriteHeader(http.StatusCreated)
+		case "PROPFIND":
+			mu.Lock()
+			var body strings.Builder
+			body.WriteString(`<?xml version="1.0"?><D:multistatus xmlns:D="DAV:">`)
+			fmt.Fprintf(&body, `<D:response><D:href>/%s</D:href><D:propstat><D:prop/></D:propstat></D:response>`, name)
+			for n, data := range files {
+				if !strings.HasPrefix(n, name) || n == name {
+					continue
+				}
+				fmt.Fprintf(&body, `<D:response><D:href>/%s</D:href><D:propstat><D:prop><D:getcontentlength>%d</D:getcontentlength></D:prop></D:propstat></D:response>`, n, len(data))
+			}
+			body.WriteString(`</D:multistatus>`)
+			mu.Unlock()
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusMultiStatus)
+			io.WriteString(w, body.String())
+		default:
+			http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+		}
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestWebDAVBackendCreateWriteReadRenameRemove(t *testing.T) {
+	srv := newTestWebDAVServer(t)
+	defer srv.Close()
+
+	b := WebDAVBackend(srv.URL, nil)
+
+	w, err := b.Create("hello.txt")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := w.Write([]byte("hello world")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	f, err := b.Open("hello.txt")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	got, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "hello world" {
+		t.Fatalf("read %q, want %q", got, "hello world")
+	}
+
+	if err := b.Rename("hello.txt", "renamed.txt"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if _, err := b.Stat("renamed.txt"); err != nil {
+		t.Fatalf("Stat after rename: %v", err)
+	}
+
+	if err := b.Remove("renamed.txt"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, err := b.Open("renamed.txt"); err == nil {
+		t.Fatal("expected Open to fail after Remove")
+	}
+}
+
+func TestWebDAVBackendReaddir(t *testing.T) {
+	srv := newTestWebDAVServer(t)
+	defer srv.Close()
+
+	b := WebDAVBackend(srv.URL, nil)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		w, err := b.Create(name)
+		if err != nil {
+			t.Fatalf("Create(%v): %v", name, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close(%v): %v", name, err)
+		}
+	}
+
+	entries, err := b.Readdir("")
+	if err != nil {
+		t.Fatalf("Readdir: %v", err)
+	}
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		seen[e.Name()] = true
+	}
+	if !seen["a.txt"] || !seen["b.txt"] {
+		t.Fatalf("Readdir = %v, missing a.txt or b.txt", seen)
+	}
+}